@@ -0,0 +1,94 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// errDaemonIndexUnsupported is returned when Optimize is asked to write a
+// multi-arch index to the local daemon, which (unlike a registry) has no
+// concept of a manifest list as a pullable entity.
+var errDaemonIndexUnsupported = errors.New("crane: writing an image index to the Docker daemon is not supported, use WithPlatform to select a single image")
+
+// daemonPrefix is how callers spell "resolve this reference against the
+// local Docker daemon instead of a remote registry", e.g.
+// Optimize("daemon://my-image:latest", "gcr.io/my-project/my-image:opt", ...).
+const daemonPrefix = "daemon://"
+
+// WithDaemonSource makes Optimize resolve src via the local Docker daemon
+// (pkg/v1/daemon.Image) instead of a remote registry. Equivalent to
+// prefixing src with "daemon://".
+func WithDaemonSource() Option {
+	return func(o *options) {
+		o.daemonSource = true
+	}
+}
+
+// WithDaemonSink makes Optimize write the optimized result back to the
+// local Docker daemon (pkg/v1/daemon.Write) instead of a remote registry.
+// Equivalent to prefixing dst with "daemon://".
+func WithDaemonSink() Option {
+	return func(o *options) {
+		o.daemonSink = true
+	}
+}
+
+// stripDaemonPrefix reports whether ref was written as "daemon://<ref>",
+// returning the reference with the prefix removed.
+func stripDaemonPrefix(ref string) (string, bool) {
+	if strings.HasPrefix(ref, daemonPrefix) {
+		return strings.TrimPrefix(ref, daemonPrefix), true
+	}
+	return ref, false
+}
+
+// imageWriter abstracts where Optimize's output is pushed, so
+// optimizeAndPushImage/optimizeAndPushIndex don't need to know whether
+// they're talking to a registry or the local daemon -- and so tests can
+// substitute a fake.
+type imageWriter interface {
+	WriteImage(ref name.Reference, img v1.Image, o options) error
+	WriteIndex(ref name.Reference, idx v1.ImageIndex, o options) error
+}
+
+// remoteWriter writes to a registry via remote.Write/WriteIndex.
+type remoteWriter struct{}
+
+func (remoteWriter) WriteImage(ref name.Reference, img v1.Image, o options) error {
+	return remote.Write(ref, img, o.remote...)
+}
+
+func (remoteWriter) WriteIndex(ref name.Reference, idx v1.ImageIndex, o options) error {
+	return remote.WriteIndex(ref, idx, o.remote...)
+}
+
+// daemonWriter writes to the local Docker daemon via daemon.Write.
+type daemonWriter struct{}
+
+func (daemonWriter) WriteImage(ref name.Reference, img v1.Image, o options) error {
+	_, err := daemon.Write(ref, img, o.daemonOpts...)
+	return err
+}
+
+func (daemonWriter) WriteIndex(name.Reference, v1.ImageIndex, options) error {
+	return errDaemonIndexUnsupported
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStripDaemonPrefix(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantRef  string
+		wantBool bool
+	}{
+		{"daemon://my-image:latest", "my-image:latest", true},
+		{"gcr.io/my-project/my-image:latest", "gcr.io/my-project/my-image:latest", false},
+	}
+	for _, tc := range tests {
+		ref, ok := stripDaemonPrefix(tc.in)
+		if ref != tc.wantRef || ok != tc.wantBool {
+			t.Errorf("stripDaemonPrefix(%q) = (%q, %v), want (%q, %v)", tc.in, ref, ok, tc.wantRef, tc.wantBool)
+		}
+	}
+}
+
+func TestDaemonWriterWriteIndexUnsupported(t *testing.T) {
+	err := daemonWriter{}.WriteIndex(nil, nil, options{})
+	if !errors.Is(err, errDaemonIndexUnsupported) {
+		t.Errorf("daemonWriter{}.WriteIndex() = %v, want %v", err, errDaemonIndexUnsupported)
+	}
+}
@@ -15,13 +15,19 @@
 package crane
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+
 	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
@@ -30,21 +36,107 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 )
 
-// Optimize optimizes a remote image or index from src to dst.
+// OptimizeFormat selects the layer format that crane.Optimize produces.
+type OptimizeFormat string
+
+const (
+	// FormatEstargz builds layers as eStargz, the default.
+	FormatEstargz OptimizeFormat = "estargz"
+	// FormatZstdChunked builds layers as zstd:chunked.
+	FormatZstdChunked OptimizeFormat = "zstd-chunked"
+)
+
+// WithOptimizeFormat sets the layer format that Optimize produces.
+// Defaults to FormatEstargz.
+func WithOptimizeFormat(format OptimizeFormat) Option {
+	return func(o *options) {
+		o.optimizeFormat = format
+	}
+}
+
+// WithOptimizeStripHistory makes Optimize drop the config history for
+// re-encoded layers, matching its behavior before history preservation was
+// added. Labels and the diffIDs of the new layers are kept either way.
+// Defaults to false: Optimize preserves history by default, annotating the
+// entries for re-encoded layers.
+func WithOptimizeStripHistory(strip bool) Option {
+	return func(o *options) {
+		o.stripHistory = strip
+	}
+}
+
+// WithPrioritizationFromRegistry makes Optimize look up a
+// PrioritizedFilesRecord previously pushed with RecordPrioritizedFiles for
+// src, merging its per-layer file lists into the explicit prioritize
+// argument. This lets a trace collected on one machine's runtime drive
+// optimization on another, without the caller having to thread the file
+// list through out-of-band.
+func WithPrioritizationFromRegistry() Option {
+	return func(o *options) {
+		o.prioritizeFromRegistry = true
+	}
+}
+
+// Optimize optimizes an image or index from src to dst. src and dst are
+// read from and written to a remote registry by default; prefixing either
+// with "daemon://" (or passing WithDaemonSource/WithDaemonSink) resolves
+// it against the local Docker daemon instead, e.g. to optimize an image
+// just built locally without first pushing it to a registry.
 // THIS API IS EXPERIMENTAL AND SUBJECT TO CHANGE WITHOUT WARNING.
 func Optimize(src, dst string, prioritize sets.String, opt ...Option) error {
 	o := makeOptions(opt...)
+
+	src, fromDaemon := stripDaemonPrefix(src)
+	o.daemonSource = o.daemonSource || fromDaemon
 	srcRef, err := name.ParseReference(src, o.name...)
 	if err != nil {
 		return fmt.Errorf("parsing reference %q: %v", src, err)
 	}
 
+	dst, toDaemon := stripDaemonPrefix(dst)
+	o.daemonSink = o.daemonSink || toDaemon
 	dstRef, err := name.ParseReference(dst, o.name...)
 	if err != nil {
 		return fmt.Errorf("parsing reference for %q: %v", dst, err)
 	}
 
+	var writer imageWriter = remoteWriter{}
+	if o.daemonSink {
+		writer = daemonWriter{}
+	}
+
 	logs.Progress.Printf("Optimizing from %v to %v", srcRef, dstRef)
+
+	// Shared across every layer-compression goroutine, however deeply
+	// nested (a single image, or every layer of every child of an index),
+	// so the total number of concurrent compressions matches WithJobs
+	// instead of multiplying out per nesting level.
+	sem := semaphore.NewWeighted(int64(o.jobs))
+
+	// src has already had any "daemon://" prefix stripped above, so this
+	// looks up the record against the registry the image came from even
+	// when WithDaemonSource makes us read the image itself from the local
+	// daemon instead of pulling it.
+	if o.prioritizeFromRegistry {
+		record, err := LookupPrioritizedFiles(src, opt...)
+		if err != nil {
+			logs.Warn.Printf("WithPrioritizationFromRegistry: %v, falling back to explicit --prioritize only", err)
+		} else {
+			o.prioritizedRecord = record
+		}
+	}
+
+	if o.daemonSource {
+		img, err := daemon.Image(srcRef, o.daemonOpts...)
+		if err != nil {
+			return fmt.Errorf("fetching %q from daemon: %v", src, err)
+		}
+		if err := optimizeAndPushImage(img, dstRef, prioritize, o, writer, sem); err != nil {
+			return fmt.Errorf("failed to optimize image: %v", err)
+		}
+		return nil
+	}
+
 	desc, err := remote.Get(srcRef, o.remote...)
 	if err != nil {
 		return fmt.Errorf("fetching %q: %v", src, err)
@@ -55,11 +147,26 @@ func Optimize(src, dst string, prioritize sets.String, opt ...Option) error {
 		// Handle indexes separately.
 		if o.platform != nil {
 			// If platform is explicitly set, don't optimize the whole index, just the appropriate image.
-			if err := optimizeAndPushImage(desc, dstRef, prioritize, o); err != nil {
+			img, err := desc.Image()
+			if err != nil {
+				return fmt.Errorf("failed to optimize image: %v", err)
+			}
+			if err := optimizeAndPushImage(img, dstRef, prioritize, o, writer, sem); err != nil {
 				return fmt.Errorf("failed to optimize image: %v", err)
 			}
 		} else {
-			if err := optimizeAndPushIndex(desc, dstRef, prioritize, o); err != nil {
+			// The daemon has no concept of a pullable manifest list, so
+			// daemonWriter.WriteIndex always fails: check that up front
+			// rather than paying for a full parallel optimization of every
+			// child image only to throw the result away.
+			if o.daemonSink {
+				return fmt.Errorf("failed to optimize index: %w", errDaemonIndexUnsupported)
+			}
+			idx, err := desc.ImageIndex()
+			if err != nil {
+				return fmt.Errorf("failed to optimize index: %v", err)
+			}
+			if err := optimizeAndPushIndex(idx, dstRef, prioritize, o, writer, sem); err != nil {
 				return fmt.Errorf("failed to optimize index: %v", err)
 			}
 		}
@@ -69,7 +176,11 @@ func Optimize(src, dst string, prioritize sets.String, opt ...Option) error {
 
 	default:
 		// Assume anything else is an image, since some registries don't set mediaTypes properly.
-		if err := optimizeAndPushImage(desc, dstRef, prioritize, o); err != nil {
+		img, err := desc.Image()
+		if err != nil {
+			return fmt.Errorf("failed to optimize image: %v", err)
+		}
+		if err := optimizeAndPushImage(img, dstRef, prioritize, o, writer, sem); err != nil {
 			return fmt.Errorf("failed to optimize image: %v", err)
 		}
 	}
@@ -77,13 +188,8 @@ func Optimize(src, dst string, prioritize sets.String, opt ...Option) error {
 	return nil
 }
 
-func optimizeAndPushImage(desc *remote.Descriptor, dstRef name.Reference, prioritize sets.String, o options) error {
-	img, err := desc.Image()
-	if err != nil {
-		return err
-	}
-
-	missing, oimg, err := optimizeImage(img, prioritize)
+func optimizeAndPushImage(img v1.Image, dstRef name.Reference, prioritize sets.String, o options, writer imageWriter, sem *semaphore.Weighted) error {
+	missing, oimg, err := optimizeImage(img, prioritize, o, sem)
 	if err != nil {
 		return err
 	}
@@ -92,10 +198,15 @@ func optimizeAndPushImage(desc *remote.Descriptor, dstRef name.Reference, priori
 		return fmt.Errorf("the following prioritized files were missing from image: %v", missing.List())
 	}
 
-	return remote.Write(dstRef, oimg, o.remote...)
+	return writer.WriteImage(dstRef, oimg, o)
 }
 
-func optimizeImage(img v1.Image, prioritize sets.String) (sets.String, v1.Image, error) {
+// optimizeImage re-encodes img's layers according to o, acquiring sem
+// before compressing each layer so that, even when optimizeImage is called
+// concurrently for every child of an index, the total number of layers
+// being compressed at once across the whole Optimize call is bounded by
+// sem's capacity (WithJobs) rather than by WithJobs per image.
+func optimizeImage(img v1.Image, prioritize sets.String, o options, sem *semaphore.Weighted) (sets.String, v1.Image, error) {
 	cfg, err := img.ConfigFile()
 	if err != nil {
 		return nil, nil, err
@@ -114,41 +225,141 @@ func optimizeImage(img v1.Image, prioritize sets.String) (sets.String, v1.Image,
 		return nil, nil, err
 	}
 
+	// mutate.Append recomputes DiffIDs from the layers we give it, so as
+	// long as we feed it one History entry per layer (in order), the
+	// resulting config keeps a consistent History/DiffID chain. We only do
+	// this when the caller hasn't asked for the old strip-everything
+	// behavior.
+	var origHistory []v1.History
+	if !o.stripHistory {
+		origHistory = nonEmptyLayerHistory(cfg.History)
+	}
+
+	perLayerPrioritize := mergePrioritizedFiles(prioritize.List(), o.prioritizedRecord, cfg.RootFS.DiffIDs)
+
 	missingFromImage := sets.NewString(prioritize.UnsortedList()...)
-	olayers := make([]mutate.Addendum, 0, len(layers))
-	for _, layer := range layers {
-		missingFromLayer := []string{}
-		olayer, err := tarball.LayerFromOpener(layer.Uncompressed,
-			tarball.WithEstargz,
-			tarball.WithEstargzOptions(
-				estargz.WithPrioritizedFiles(prioritize.List()),
-				estargz.WithAllowPrioritizeNotFound(&missingFromLayer),
-			))
-		if err != nil {
-			return nil, nil, err
-		}
-		missingFromImage = missingFromImage.Intersection(sets.NewString(missingFromLayer...))
+	var missingMu sync.Mutex
+	olayers := make([]mutate.Addendum, len(layers))
+
+	g := new(errgroup.Group)
+	for i, layer := range layers {
+		i, layer := i, layer
+		g.Go(func() error {
+			if err := sem.Acquire(context.Background(), 1); err != nil {
+				return err
+			}
+			defer sem.Release(1)
+
+			missingFromLayer := []string{}
+
+			var tarOpts []tarball.LayerOpt
+			mt := types.DockerLayer
+			switch o.optimizeFormat {
+			case FormatZstdChunked:
+				tarOpts = []tarball.LayerOpt{
+					tarball.WithZstdChunked,
+					tarball.WithEstargzOptions(
+						estargz.WithPrioritizedFiles(perLayerPrioritize[i]),
+					),
+				}
+				mt = tarball.ZstdChunkedMediaType
+			default:
+				tarOpts = []tarball.LayerOpt{
+					tarball.WithEstargz,
+					tarball.WithEstargzOptions(
+						estargz.WithPrioritizedFiles(perLayerPrioritize[i]),
+						estargz.WithAllowPrioritizeNotFound(&missingFromLayer),
+					),
+				}
+			}
+
+			olayer, err := tarball.LayerFromOpener(layer.Uncompressed, tarOpts...)
+			if err != nil {
+				return err
+			}
+
+			// WithZstdChunked has no WithAllowPrioritizeNotFound equivalent
+			// to populate missingFromLayer as a side effect, so read it
+			// back from the layer directly.
+			if o.optimizeFormat == FormatZstdChunked {
+				if lm, ok := olayer.(tarball.LayerWithMissingPrioritizedFiles); ok {
+					m, err := lm.MissingPrioritizedFiles()
+					if err != nil {
+						return err
+					}
+					missingFromLayer = m
+				}
+			}
+
+			missingMu.Lock()
+			missingFromImage = missingFromImage.Intersection(sets.NewString(missingFromLayer...))
+			missingMu.Unlock()
+
+			var history v1.History
+			if i < len(origHistory) {
+				history = origHistory[i]
+				history.Comment = appendOptimizedComment(history.Comment, o.optimizeFormat)
+			}
 
-		olayers = append(olayers, mutate.Addendum{
-			Layer:     olayer,
-			MediaType: types.DockerLayer,
+			olayers[i] = mutate.Addendum{
+				Layer:     olayer,
+				History:   history,
+				MediaType: mt,
+			}
+			return nil
 		})
 	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
 
 	oimg, err = mutate.Append(oimg, olayers...)
 	if err != nil {
 		return nil, nil, err
 	}
+	if o.stripHistory {
+		// mutate.Append records one (empty) History entry per layer, so
+		// clear them to leave the config with no history at all.
+		scfg, err := oimg.ConfigFile()
+		if err != nil {
+			return nil, nil, err
+		}
+		scfg = scfg.DeepCopy()
+		scfg.History = nil
+		if oimg, err = mutate.ConfigFile(oimg, scfg); err != nil {
+			return nil, nil, err
+		}
+	}
 	return missingFromImage, oimg, nil
 }
 
-func optimizeAndPushIndex(desc *remote.Descriptor, dstRef name.Reference, prioritize sets.String, o options) error {
-	idx, err := desc.ImageIndex()
-	if err != nil {
-		return err
+// nonEmptyLayerHistory returns the subset of history that corresponds to
+// an actual layer, in the same order v1.Image.Layers() returns them,
+// dropping the entries image builders leave behind for commands (e.g. ENV,
+// LABEL) that didn't produce a layer.
+func nonEmptyLayerHistory(history []v1.History) []v1.History {
+	out := make([]v1.History, 0, len(history))
+	for _, h := range history {
+		if !h.EmptyLayer {
+			out = append(out, h)
+		}
 	}
+	return out
+}
 
-	missing, oidx, err := optimizeIndex(idx, prioritize)
+// appendOptimizedComment records which Optimize format produced a layer in
+// its history comment, so downstream tooling inspecting provenance can
+// tell a re-encoded layer from the original.
+func appendOptimizedComment(comment string, format OptimizeFormat) string {
+	note := fmt.Sprintf("optimized: %s", format)
+	if comment == "" {
+		return note
+	}
+	return comment + "; " + note
+}
+
+func optimizeAndPushIndex(idx v1.ImageIndex, dstRef name.Reference, prioritize sets.String, o options, writer imageWriter, sem *semaphore.Weighted) error {
+	missing, oidx, err := optimizeIndex(idx, prioritize, o, sem)
 	if err != nil {
 		return err
 	}
@@ -157,40 +368,57 @@ func optimizeAndPushIndex(desc *remote.Descriptor, dstRef name.Reference, priori
 		return fmt.Errorf("the following prioritized files were missing from all images: %v", missing.List())
 	}
 
-	return remote.WriteIndex(dstRef, oidx, o.remote...)
+	return writer.WriteIndex(dstRef, oidx, o)
 }
 
-func optimizeIndex(idx v1.ImageIndex, prioritize sets.String) (sets.String, v1.ImageIndex, error) {
+func optimizeIndex(idx v1.ImageIndex, prioritize sets.String, o options, sem *semaphore.Weighted) (sets.String, v1.ImageIndex, error) {
 	im, err := idx.IndexManifest()
 	if err != nil {
 		return nil, nil, err
 	}
 
 	missingFromIndex := sets.NewString(prioritize.UnsortedList()...)
+	var missingMu sync.Mutex
 
-	// Build an image for each child from the base and append it to a new index to produce the result.
-	adds := make([]mutate.IndexAddendum, 0, len(im.Manifests))
-	for _, desc := range im.Manifests {
-		img, err := idx.Image(desc.Digest)
-		if err != nil {
-			return nil, nil, err
-		}
+	// Build an image for each child from the base and append it to a new
+	// index to produce the result. Fanning every child out unbounded here
+	// is fine: the only real CPU-bound work happens per-layer inside
+	// optimizeImage, which acquires sem itself, so the shared semaphore
+	// (not this loop) is what bounds total concurrency to WithJobs.
+	adds := make([]mutate.IndexAddendum, len(im.Manifests))
+	g := new(errgroup.Group)
+	for i, desc := range im.Manifests {
+		i, desc := i, desc
+		g.Go(func() error {
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return err
+			}
 
-		missingFromImage, oimg, err := optimizeImage(img, prioritize)
-		if err != nil {
-			return nil, nil, err
-		}
-		missingFromIndex = missingFromIndex.Intersection(missingFromImage)
-		adds = append(adds, mutate.IndexAddendum{
-			Add: oimg,
-			Descriptor: v1.Descriptor{
-				URLs:        desc.URLs,
-				MediaType:   desc.MediaType,
-				Annotations: desc.Annotations,
-				Platform:    desc.Platform,
-			},
+			missingFromImage, oimg, err := optimizeImage(img, prioritize, o, sem)
+			if err != nil {
+				return err
+			}
+
+			missingMu.Lock()
+			missingFromIndex = missingFromIndex.Intersection(missingFromImage)
+			missingMu.Unlock()
+
+			adds[i] = mutate.IndexAddendum{
+				Add: oimg,
+				Descriptor: v1.Descriptor{
+					URLs:        desc.URLs,
+					MediaType:   desc.MediaType,
+					Annotations: desc.Annotations,
+					Platform:    desc.Platform,
+				},
+			}
+			return nil
 		})
 	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
 
 	idxType, err := idx.MediaType()
 	if err != nil {
@@ -0,0 +1,187 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"golang.org/x/sync/semaphore"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// singleFileTar returns an Opener producing a one-entry uncompressed tar,
+// the same shape a real build context layer would be.
+func singleFileTar(name, body string) tarball.Opener {
+	return func() (io.ReadCloser, error) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(body)), Mode: 0644}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			return nil, err
+		}
+		if err := tw.Close(); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+}
+
+// buildTestImage assembles a real v1.Image the way mutate.Append normally
+// would -- one real tarball layer per body, each carrying the given
+// history entry -- so optimizeImage sees exactly the inputs a real caller
+// would give it, rather than a hand-rolled fake.
+func buildTestImage(t *testing.T, bodies []string, histories []v1.History) v1.Image {
+	t.Helper()
+	img := empty.Image
+	for i, body := range bodies {
+		layer, err := tarball.LayerFromOpener(singleFileTar("file", body))
+		if err != nil {
+			t.Fatalf("LayerFromOpener: %v", err)
+		}
+		h := v1.History{CreatedBy: "ADD file"}
+		if i < len(histories) {
+			h = histories[i]
+		}
+		img, err = mutate.Append(img, mutate.Addendum{Layer: layer, History: h})
+		if err != nil {
+			t.Fatalf("mutate.Append: %v", err)
+		}
+	}
+	return img
+}
+
+func TestOptimizeImageEndToEnd(t *testing.T) {
+	src := buildTestImage(t,
+		[]string{"hello world"},
+		[]v1.History{{CreatedBy: "ADD file", Comment: "built by test"}},
+	)
+
+	o := makeOptions()
+	missing, oimg, err := optimizeImage(src, sets.NewString(), o, semaphore.NewWeighted(int64(o.jobs)))
+	if err != nil {
+		t.Fatalf("optimizeImage: %v", err)
+	}
+	if missing.Len() != 0 {
+		t.Errorf("missing = %v, want empty", missing.List())
+	}
+
+	layers, err := oimg.Layers()
+	if err != nil {
+		t.Fatalf("Layers: %v", err)
+	}
+	if len(layers) != 1 {
+		t.Fatalf("got %d layers, want 1", len(layers))
+	}
+
+	mt, err := layers[0].MediaType()
+	if err != nil {
+		t.Fatalf("MediaType: %v", err)
+	}
+	if mt != types.DockerLayer {
+		t.Errorf("MediaType = %s, want %s", mt, types.DockerLayer)
+	}
+
+	// This is the check that would have caught the default-path gzip
+	// regression: a layer claiming DockerLayer media type must actually be
+	// a valid gzip stream, not a raw tar.
+	rc, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	defer rc.Close()
+	if _, err := gzip.NewReader(rc); err != nil {
+		t.Errorf("layer claims %s but is not valid gzip: %v", mt, err)
+	}
+
+	cfg, err := oimg.ConfigFile()
+	if err != nil {
+		t.Fatalf("ConfigFile: %v", err)
+	}
+	if len(cfg.History) != 1 {
+		t.Fatalf("got %d history entries, want 1", len(cfg.History))
+	}
+	want := "built by test; optimized: estargz"
+	if cfg.History[0].Comment != want {
+		t.Errorf("History[0].Comment = %q, want %q", cfg.History[0].Comment, want)
+	}
+	if len(cfg.RootFS.DiffIDs) != 1 {
+		t.Errorf("got %d DiffIDs, want 1", len(cfg.RootFS.DiffIDs))
+	}
+}
+
+func TestOptimizeImageEndToEndStripHistory(t *testing.T) {
+	src := buildTestImage(t,
+		[]string{"hello world"},
+		[]v1.History{{CreatedBy: "ADD file", Comment: "built by test"}},
+	)
+
+	o := makeOptions(WithOptimizeStripHistory(true))
+	_, oimg, err := optimizeImage(src, sets.NewString(), o, semaphore.NewWeighted(int64(o.jobs)))
+	if err != nil {
+		t.Fatalf("optimizeImage: %v", err)
+	}
+
+	cfg, err := oimg.ConfigFile()
+	if err != nil {
+		t.Fatalf("ConfigFile: %v", err)
+	}
+	if len(cfg.History) != 0 {
+		t.Errorf("got %d history entries with WithOptimizeStripHistory, want 0: %#v", len(cfg.History), cfg.History)
+	}
+}
+
+func TestOptimizeIndexEndToEnd(t *testing.T) {
+	amd64 := buildTestImage(t, []string{"amd64 content"}, nil)
+	arm64 := buildTestImage(t, []string{"arm64 content"}, nil)
+
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+
+	o := makeOptions()
+	missing, oidx, err := optimizeIndex(idx, sets.NewString(), o, semaphore.NewWeighted(int64(o.jobs)))
+	if err != nil {
+		t.Fatalf("optimizeIndex: %v", err)
+	}
+	if missing.Len() != 0 {
+		t.Errorf("missing = %v, want empty", missing.List())
+	}
+
+	im, err := oidx.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest: %v", err)
+	}
+	if len(im.Manifests) != 2 {
+		t.Fatalf("got %d children, want 2", len(im.Manifests))
+	}
+	for _, m := range im.Manifests {
+		if m.Platform == nil {
+			t.Errorf("child manifest lost its Platform descriptor")
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestNonEmptyLayerHistory(t *testing.T) {
+	history := []v1.History{
+		{CreatedBy: "FROM scratch", EmptyLayer: true},
+		{CreatedBy: "ADD a /a"},
+		{CreatedBy: "LABEL foo=bar", EmptyLayer: true},
+		{CreatedBy: "ADD b /b"},
+	}
+
+	got := nonEmptyLayerHistory(history)
+	want := []v1.History{
+		{CreatedBy: "ADD a /a"},
+		{CreatedBy: "ADD b /b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nonEmptyLayerHistory = %#v, want %#v", got, want)
+	}
+}
+
+func TestAppendOptimizedComment(t *testing.T) {
+	tests := []struct {
+		comment string
+		format  OptimizeFormat
+		want    string
+	}{
+		{"", FormatEstargz, "optimized: estargz"},
+		{"ADD a /a", FormatZstdChunked, "ADD a /a; optimized: zstd-chunked"},
+	}
+	for _, tc := range tests {
+		if got := appendOptimizedComment(tc.comment, tc.format); got != tc.want {
+			t.Errorf("appendOptimizedComment(%q, %q) = %q, want %q", tc.comment, tc.format, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"runtime"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Option is a functional option for crane operations.
+type Option func(*options)
+
+type options struct {
+	name     []name.Option
+	remote   []remote.Option
+	platform *v1.Platform
+
+	// optimizeFormat is the layer format crane.Optimize produces.
+	optimizeFormat OptimizeFormat
+
+	// prioritizeFromRegistry and prioritizedRecord back
+	// WithPrioritizationFromRegistry: the former is set by the option, the
+	// latter is populated by Optimize once it has looked the record up.
+	prioritizeFromRegistry bool
+	prioritizedRecord      *PrioritizedFilesRecord
+
+	// jobs bounds how many layers crane.Optimize converts (and
+	// how many blobs remote.Write pushes) concurrently.
+	jobs int
+
+	// stripHistory makes Optimize drop config history for re-encoded layers
+	// instead of preserving it.
+	stripHistory bool
+
+	// daemonSource and daemonSink back WithDaemonSource/WithDaemonSink.
+	daemonSource bool
+	daemonSink   bool
+	daemonOpts   []daemon.Option
+}
+
+func makeOptions(opts ...Option) options {
+	o := options{
+		platform: &v1.Platform{
+			Architecture: "amd64",
+			OS:           "linux",
+		},
+		optimizeFormat: FormatEstargz,
+		jobs:           runtime.NumCPU(),
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// A non-positive job count would make the semaphore that Optimize
+	// bounds layer compression with block forever instead of running
+	// anything, so clamp it to at least one
+	// rather than trusting WithJobs callers to pass a sane value.
+	if o.jobs < 1 {
+		o.jobs = 1
+	}
+
+	if o.platform != nil {
+		o.remote = append(o.remote, remote.WithPlatform(*o.platform))
+	}
+	o.remote = append(o.remote, remote.WithJobs(o.jobs))
+
+	return o
+}
+
+// WithJobs sets the total number of layers crane.Optimize compresses
+// concurrently across the whole call -- whether it's optimizing a single
+// image or every layer of every child of a multi-platform index -- and the
+// number of blobs remote.Write pushes concurrently. Defaults to
+// runtime.NumCPU().
+func WithJobs(jobs int) Option {
+	return func(o *options) {
+		o.jobs = jobs
+	}
+}
+
+// WithPlatform is an Option to specify the platform to pull.
+func WithPlatform(platform *v1.Platform) Option {
+	return func(o *options) {
+		o.platform = platform
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import "testing"
+
+func TestMakeOptionsClampsNonPositiveJobs(t *testing.T) {
+	for _, jobs := range []int{0, -1, -100} {
+		o := makeOptions(WithJobs(jobs))
+		if o.jobs < 1 {
+			t.Errorf("WithJobs(%d): o.jobs = %d, want >= 1", jobs, o.jobs)
+		}
+	}
+}
+
+func TestMakeOptionsPreservesPositiveJobs(t *testing.T) {
+	o := makeOptions(WithJobs(7))
+	if o.jobs != 7 {
+		t.Errorf("WithJobs(7): o.jobs = %d, want 7", o.jobs)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// createdAnnotation is the standard OCI annotation RecordPrioritizedFiles
+// stamps on each artifact it pushes, so findPrioritizedFilesReferrer can
+// tell which of several referrers is newest instead of trusting the order
+// the referrers API happens to return them in (which the spec doesn't
+// guarantee).
+const createdAnnotation = "org.opencontainers.image.created"
+
+// PrioritizedFilesArtifactType is the OCI artifact type (and config media
+// type) used for records pushed by RecordPrioritizedFiles and fetched by
+// LookupPrioritizedFiles.
+const PrioritizedFilesArtifactType = types.MediaType("application/vnd.go-containerregistry.optimize.prioritized-files.v1+json")
+
+// PrioritizedFilesRecord is the payload of a prioritized-files artifact: a
+// list of files to prioritize for each layer of the image it's attached
+// to, keyed by the layer's diffID so the record survives re-tagging.
+type PrioritizedFilesRecord struct {
+	Layers []PrioritizedFilesLayer `json:"layers"`
+}
+
+// PrioritizedFilesLayer is the prioritized file list for a single layer.
+type PrioritizedFilesLayer struct {
+	DiffID string   `json:"diffID"`
+	Files  []string `json:"files"`
+}
+
+// RecordPrioritizedFiles pushes record as an OCI artifact referrer of ref,
+// so that a later call to LookupPrioritizedFiles (potentially against a
+// different tag of the same image, or from a different machine) can find
+// it and feed it back into Optimize via WithPrioritizationFromRegistry.
+func RecordPrioritizedFiles(ref string, record PrioritizedFilesRecord, opt ...Option) error {
+	o := makeOptions(opt...)
+	srcRef, err := name.ParseReference(ref, o.name...)
+	if err != nil {
+		return fmt.Errorf("parsing reference %q: %v", ref, err)
+	}
+
+	desc, err := remote.Get(srcRef, o.remote...)
+	if err != nil {
+		return fmt.Errorf("fetching %q: %v", ref, err)
+	}
+
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshaling prioritized files record: %v", err)
+	}
+
+	img, err := newPrioritizedFilesArtifact(payload)
+	if err != nil {
+		return fmt.Errorf("building prioritized files artifact: %v", err)
+	}
+
+	img, err = mutate.Subject(img, v1.Descriptor{
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+		Digest:    desc.Digest,
+	})
+	if err != nil {
+		return fmt.Errorf("setting subject: %v", err)
+	}
+
+	// Stamp a creation time so a later LookupPrioritizedFiles can pick the
+	// newest of several referrers instead of guessing from API order.
+	img = mutate.Annotations(img, map[string]string{
+		createdAnnotation: time.Now().UTC().Format(time.RFC3339),
+	}).(v1.Image)
+
+	// Until every registry speaks the OCI 1.1 referrers API, also tag the
+	// artifact with a predictable, digest-derived name so
+	// findPrioritizedFilesReferrer has a fallback to look up.
+	artifactRef := prioritizedFilesTag(srcRef.Context(), desc.Digest)
+	return remote.Write(artifactRef, img, o.remote...)
+}
+
+// LookupPrioritizedFiles fetches the newest PrioritizedFilesRecord attached
+// to ref as a referrer, walking the OCI 1.1 referrers API and falling back
+// to the tag-schema convention used by RecordPrioritizedFiles for
+// registries that don't yet implement it.
+func LookupPrioritizedFiles(ref string, opt ...Option) (*PrioritizedFilesRecord, error) {
+	o := makeOptions(opt...)
+	srcRef, err := name.ParseReference(ref, o.name...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing reference %q: %v", ref, err)
+	}
+
+	desc, err := remote.Get(srcRef, o.remote...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %q: %v", ref, err)
+	}
+	digestRef := srcRef.Context().Digest(desc.Digest.String())
+
+	referrerDesc, err := findPrioritizedFilesReferrer(digestRef, desc.Digest, o)
+	if err != nil {
+		return nil, err
+	}
+	if referrerDesc == nil {
+		return nil, fmt.Errorf("no prioritized-files artifact found for %q", ref)
+	}
+
+	// referrerDesc.Digest is the digest of the referrer's manifest, not of
+	// a blob: resolve it as an image and read its payload back out of its
+	// one layer, rather than fetching it as a layer directly.
+	artifact, err := remote.Image(srcRef.Context().Digest(referrerDesc.Digest.String()), o.remote...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching artifact manifest: %v", err)
+	}
+	layers, err := artifact.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("reading artifact manifest: %v", err)
+	}
+	if len(layers) != 1 {
+		return nil, fmt.Errorf("prioritized-files artifact has %d layers, want 1", len(layers))
+	}
+	rc, err := layers[0].Uncompressed()
+	if err != nil {
+		return nil, fmt.Errorf("reading artifact layer: %v", err)
+	}
+	defer rc.Close()
+
+	raw, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("reading artifact payload: %v", err)
+	}
+
+	var record PrioritizedFilesRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return nil, fmt.Errorf("unmarshaling prioritized files record: %v", err)
+	}
+	return &record, nil
+}
+
+// findPrioritizedFilesReferrer walks digestRef's referrers looking for the
+// newest manifest with PrioritizedFilesArtifactType, falling back to the
+// `sha256-<hex>.prioritized-files` tag RecordPrioritizedFiles also writes,
+// for registries without referrers API support. digest is digestRef's
+// digest, passed alongside it so the fallback can rebuild the same tag
+// RecordPrioritizedFiles wrote without reparsing digestRef.
+func findPrioritizedFilesReferrer(digestRef name.Digest, digest v1.Hash, o options) (*v1.Descriptor, error) {
+	idx, err := remote.Referrers(digestRef, o.remote...)
+	if err == nil {
+		im, err := idx.IndexManifest()
+		if err == nil {
+			if newest := newestPrioritizedFilesReferrer(im.Manifests); newest != nil {
+				return newest, nil
+			}
+		}
+	}
+
+	fallbackRef := prioritizedFilesTag(digestRef.Context(), digest)
+	desc, err := remote.Head(fallbackRef, o.remote...)
+	if err != nil {
+		return nil, nil //nolint:nilerr // no referrer found is not an error, just a miss
+	}
+	return &v1.Descriptor{
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+		Digest:    desc.Digest,
+	}, nil
+}
+
+// newestPrioritizedFilesReferrer returns whichever manifest among
+// candidates has PrioritizedFilesArtifactType and the latest createdAnnotation,
+// or nil if none qualify. The OCI referrers API makes no ordering
+// guarantee, so this ranks by the annotation rather than trusting list
+// order; a referrer with no (or an unparseable) annotation sorts as the
+// oldest possible time, so it only wins if nothing else qualifies.
+func newestPrioritizedFilesReferrer(candidates []v1.Descriptor) *v1.Descriptor {
+	var newest *v1.Descriptor
+	var newestCreated time.Time
+	for i := range candidates {
+		m := candidates[i]
+		if m.ArtifactType != PrioritizedFilesArtifactType {
+			continue
+		}
+		created, _ := time.Parse(time.RFC3339, m.Annotations[createdAnnotation])
+		if newest == nil || created.After(newestCreated) {
+			newest = &m
+			newestCreated = created
+		}
+	}
+	return newest
+}
+
+// prioritizedFilesTag returns the predictable, digest-derived tag
+// RecordPrioritizedFiles writes its artifact under and
+// findPrioritizedFilesReferrer falls back to looking up, so both sides stay
+// in sync on the tag schema.
+func prioritizedFilesTag(repo name.Repository, digest v1.Hash) name.Tag {
+	return repo.Tag(fmt.Sprintf("sha256-%s.prioritized-files", digest.Hex))
+}
+
+// newPrioritizedFilesArtifact wraps payload as a minimal single-layer OCI
+// artifact image: an empty config with PrioritizedFilesArtifactType, and
+// the JSON payload as the image's only layer.
+func newPrioritizedFilesArtifact(payload []byte) (v1.Image, error) {
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:     layer,
+		MediaType: PrioritizedFilesArtifactType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mutate.MediaType(mutate.ConfigMediaType(img, PrioritizedFilesArtifactType), types.OCIManifestSchema1), nil
+}
+
+// mergePrioritizedFiles combines the caller-supplied prioritize set with a
+// registry-fetched record, keyed by layer index, returning the union for
+// each layer so WithPrioritizationFromRegistry augments rather than
+// replaces an explicit --prioritize argument.
+func mergePrioritizedFiles(explicit []string, record *PrioritizedFilesRecord, diffIDs []v1.Hash) [][]string {
+	perLayer := make([][]string, len(diffIDs))
+	byDiffID := map[string][]string{}
+	if record != nil {
+		for _, l := range record.Layers {
+			byDiffID[l.DiffID] = l.Files
+		}
+	}
+
+	for i, d := range diffIDs {
+		files := append([]string{}, explicit...)
+		files = append(files, byDiffID[d.String()]...)
+		sort.Strings(files)
+		perLayer[i] = dedupe(files)
+	}
+	return perLayer
+}
+
+func dedupe(in []string) []string {
+	out := make([]string, 0, len(in))
+	var last string
+	for i, s := range in {
+		if i == 0 || s != last {
+			out = append(out, s)
+		}
+		last = s
+	}
+	return out
+}
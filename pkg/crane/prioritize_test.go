@@ -0,0 +1,129 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func mustHash(t *testing.T, s string) v1.Hash {
+	t.Helper()
+	h, err := v1.NewHash(s)
+	if err != nil {
+		t.Fatalf("v1.NewHash(%q): %v", s, err)
+	}
+	return h
+}
+
+func TestMergePrioritizedFiles(t *testing.T) {
+	diffIDs := []v1.Hash{
+		mustHash(t, "sha256:0000000000000000000000000000000000000000000000000000000000000000"),
+		mustHash(t, "sha256:1111111111111111111111111111111111111111111111111111111111111111"),
+	}
+	record := &PrioritizedFilesRecord{
+		Layers: []PrioritizedFilesLayer{
+			{DiffID: diffIDs[0].String(), Files: []string{"b", "a"}},
+		},
+	}
+
+	got := mergePrioritizedFiles([]string{"a", "c"}, record, diffIDs)
+	want := [][]string{
+		{"a", "b", "c"},
+		{"a", "c"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergePrioritizedFiles = %v, want %v", got, want)
+	}
+}
+
+func TestMergePrioritizedFilesNoRecord(t *testing.T) {
+	diffIDs := []v1.Hash{mustHash(t, "sha256:0000000000000000000000000000000000000000000000000000000000000000")}
+	got := mergePrioritizedFiles([]string{"a", "a"}, nil, diffIDs)
+	want := [][]string{{"a"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergePrioritizedFiles = %v, want %v", got, want)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	got := dedupe([]string{"a", "a", "b", "b", "b", "c"})
+	want := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dedupe = %v, want %v", got, want)
+	}
+}
+
+func TestNewestPrioritizedFilesReferrer(t *testing.T) {
+	other := v1.Descriptor{ArtifactType: "application/vnd.other.v1+json"}
+	old := v1.Descriptor{
+		ArtifactType: PrioritizedFilesArtifactType,
+		Digest:       mustHash(t, "sha256:0000000000000000000000000000000000000000000000000000000000000000"),
+		Annotations:  map[string]string{createdAnnotation: "2020-01-01T00:00:00Z"},
+	}
+	newer := v1.Descriptor{
+		ArtifactType: PrioritizedFilesArtifactType,
+		Digest:       mustHash(t, "sha256:1111111111111111111111111111111111111111111111111111111111111111"),
+		Annotations:  map[string]string{createdAnnotation: "2021-01-01T00:00:00Z"},
+	}
+
+	// Intentionally out of chronological order: the real API gives no
+	// ordering guarantee, so the newer one must still win when it's first.
+	got := newestPrioritizedFilesReferrer([]v1.Descriptor{other, newer, old})
+	if got == nil || got.Digest != newer.Digest {
+		t.Errorf("newestPrioritizedFilesReferrer = %v, want %v", got, newer.Digest)
+	}
+}
+
+func TestNewestPrioritizedFilesReferrerNoCandidates(t *testing.T) {
+	other := v1.Descriptor{ArtifactType: "application/vnd.other.v1+json"}
+	if got := newestPrioritizedFilesReferrer([]v1.Descriptor{other}); got != nil {
+		t.Errorf("newestPrioritizedFilesReferrer = %v, want nil", got)
+	}
+}
+
+func TestNewestPrioritizedFilesReferrerMissingAnnotationLosesToAnyValidOne(t *testing.T) {
+	noAnnotation := v1.Descriptor{
+		ArtifactType: PrioritizedFilesArtifactType,
+		Digest:       mustHash(t, "sha256:0000000000000000000000000000000000000000000000000000000000000000"),
+	}
+	withAnnotation := v1.Descriptor{
+		ArtifactType: PrioritizedFilesArtifactType,
+		Digest:       mustHash(t, "sha256:1111111111111111111111111111111111111111111111111111111111111111"),
+		Annotations:  map[string]string{createdAnnotation: "2021-01-01T00:00:00Z"},
+	}
+
+	got := newestPrioritizedFilesReferrer([]v1.Descriptor{noAnnotation, withAnnotation})
+	if got == nil || got.Digest != withAnnotation.Digest {
+		t.Errorf("newestPrioritizedFilesReferrer = %v, want %v", got, withAnnotation.Digest)
+	}
+}
+
+func TestPrioritizedFilesTagMatchesRecordAndLookup(t *testing.T) {
+	repo, err := name.NewRepository("gcr.io/example/image")
+	if err != nil {
+		t.Fatalf("NewRepository: %v", err)
+	}
+	digest := mustHash(t, "sha256:2222222222222222222222222222222222222222222222222222222222222222")
+
+	got := prioritizedFilesTag(repo, digest)
+	want := "sha256-2222222222222222222222222222222222222222222222222222222222222222.prioritized-files"
+	if got.TagStr() != want {
+		t.Errorf("prioritizedFilesTag = %q, want %q", got.TagStr(), want)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// LayerWithMissingPrioritizedFiles is implemented by layers that can
+// report which PrioritizedFiles (see WithEstargzOptions/WithZstdChunked)
+// were not found in the tar stream, e.g. via a type assertion on the
+// v1.Layer LayerFromOpener returns. The list is only recorded for layers
+// built with WithZstdChunked.
+type LayerWithMissingPrioritizedFiles interface {
+	MissingPrioritizedFiles() ([]string, error)
+}
+
+// Opener returns a fresh reader of the uncompressed tar a layer was built
+// from. It's called once per layer consumer (e.g. once to build the layer,
+// again for each Uncompressed call), so it must be safe to call more than
+// once, with each call starting from the beginning of the tar.
+type Opener func() (io.ReadCloser, error)
+
+// LayerOpt configures how LayerFromOpener builds a layer.
+type LayerOpt func(*layerOpts) error
+
+type layerOpts struct {
+	estgz                bool
+	estargzOpts          []estargz.Option
+	zstdChunked          bool
+	zstdChunkedChunkSize int
+}
+
+// WithEstargz is a functional option that builds a layer as eStargz,
+// embedding a TOC and a footer that stargz-snapshotter can use to
+// lazily pull the layer's contents.
+func WithEstargz(o *layerOpts) error {
+	o.estgz = true
+	return nil
+}
+
+// WithEstargzOptions is a functional option passed through to
+// estargz.Build when WithEstargz is used, e.g. to set
+// estargz.WithPrioritizedFiles.
+func WithEstargzOptions(opts ...estargz.Option) LayerOpt {
+	return func(o *layerOpts) error {
+		o.estargzOpts = append(o.estargzOpts, opts...)
+		return nil
+	}
+}
+
+// layer is a v1.Layer backed by an Opener, compressed once up front
+// according to opts.
+type layer struct {
+	opener Opener
+	opts   *layerOpts
+
+	compressed []byte
+	diffID     v1.Hash // digest of the uncompressed tar.
+	digest     v1.Hash // digest of the compressed blob.
+	missing    []string
+}
+
+// LayerFromOpener returns a v1.Layer built from the uncompressed tar
+// produced by opener, applying any of the given LayerOpts (WithEstargz,
+// WithZstdChunked, ...) to decide how the layer is compressed. The layer
+// is built eagerly, so for a WithZstdChunked layer any PrioritizedFiles
+// missing from the tar stream can be read back via MissingPrioritizedFiles
+// immediately.
+func LayerFromOpener(opener Opener, opts ...LayerOpt) (v1.Layer, error) {
+	lo := &layerOpts{}
+	for _, opt := range opts {
+		if err := opt(lo); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &layer{opener: opener, opts: lo}
+	if err := l.build(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *layer) build() error {
+	rc, err := l.opener()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	raw, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	diffID, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	l.diffID = diffID
+
+	var buf bytes.Buffer
+	switch {
+	case l.opts.zstdChunked:
+		prioritized := prioritizedFiles(l.opts.estargzOpts)
+		l.missing, err = buildZstdChunked(&buf, bytes.NewReader(raw), l.opts.zstdChunkedChunkSize, prioritized)
+	default:
+		err = buildEstargzOrGzip(&buf, bytes.NewReader(raw), l.opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.compressed = buf.Bytes()
+	digest, _, err := v1.SHA256(bytes.NewReader(l.compressed))
+	if err != nil {
+		return err
+	}
+	l.digest = digest
+	return nil
+}
+
+func (l *layer) Compressed() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(l.compressed)), nil
+}
+
+func (l *layer) Uncompressed() (io.ReadCloser, error) {
+	return l.opener()
+}
+
+func (l *layer) Size() (int64, error) {
+	return int64(len(l.compressed)), nil
+}
+
+// DiffID returns the digest of the uncompressed tar, per the v1.Layer
+// contract. It is NOT the same as Digest, which is the digest of the
+// compressed blob actually pushed to the registry.
+func (l *layer) DiffID() (v1.Hash, error) {
+	return l.diffID, nil
+}
+
+// Digest returns the digest of the compressed blob. See DiffID for the
+// digest of the uncompressed content.
+func (l *layer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func (l *layer) MediaType() (types.MediaType, error) {
+	if l.opts.zstdChunked {
+		return ZstdChunkedMediaType, nil
+	}
+	if l.opts.estgz {
+		return types.DockerLayer, nil
+	}
+	return types.DockerLayer, nil
+}
+
+// MissingPrioritizedFiles returns the PrioritizedFiles (set via
+// WithEstargzOptions/estargz.WithPrioritizedFiles) that were not found in
+// the tar stream of a WithZstdChunked layer; for any other layer it returns
+// nil. Unlike the estargz path, WithZstdChunked has no
+// equivalent of estargz.WithAllowPrioritizeNotFound to populate a
+// caller-owned slice, so callers that need this list for a zstd:chunked
+// layer should type-assert to this interface instead.
+func (l *layer) MissingPrioritizedFiles() ([]string, error) {
+	return l.missing, nil
+}
+
+// prioritizedFiles pulls the PrioritizedFiles list back out of the
+// estargz.Options callers pass via WithEstargzOptions, so WithZstdChunked
+// can honor the same list without requiring a second, redundant option.
+func prioritizedFiles(opts []estargz.Option) []string {
+	var o estargz.Options
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			continue
+		}
+	}
+	return o.PrioritizedFiles
+}
+
+// buildEstargzOrGzip writes the gzip-compressed tar MediaType reports
+// (types.DockerLayer) to w: either as eStargz, or, absent WithEstargz, as a
+// plain gzip stream -- never the raw uncompressed tar, since that would no
+// longer match the media type a puller is told to expect.
+func buildEstargzOrGzip(w io.Writer, r io.Reader, lo *layerOpts) error {
+	if lo.estgz {
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		blob, err := estargz.Build(bytes.NewReader(raw), lo.estargzOpts...)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+		_, err = io.Copy(w, blob)
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	if _, err := io.Copy(gw, r); err != nil {
+		return err
+	}
+	return gw.Close()
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestLayerFromOpenerDefaultIsValidGzip(t *testing.T) {
+	l, err := LayerFromOpener(tarOpener(map[string]string{"foo": "bar"}))
+	if err != nil {
+		t.Fatalf("LayerFromOpener: %v", err)
+	}
+
+	mt, err := l.MediaType()
+	if err != nil {
+		t.Fatalf("MediaType: %v", err)
+	}
+	if mt != types.DockerLayer {
+		t.Fatalf("MediaType = %s, want %s", mt, types.DockerLayer)
+	}
+
+	rc, err := l.Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	defer rc.Close()
+
+	gr, err := gzip.NewReader(rc)
+	if err != nil {
+		t.Fatalf("the compressed blob is not valid gzip, but MediaType claims %s: %v", mt, err)
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading tar entry out of decompressed blob: %v", err)
+	}
+	if hdr.Name != "foo" {
+		t.Errorf("tar entry name = %q, want %q", hdr.Name, "foo")
+	}
+	body, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatalf("reading tar entry body: %v", err)
+	}
+	if string(body) != "bar" {
+		t.Errorf("tar entry body = %q, want %q", body, "bar")
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected exactly one tar entry")
+	}
+}
+
+func TestLayerFromOpenerDefaultCompressesUncompressedDiffers(t *testing.T) {
+	l, err := LayerFromOpener(tarOpener(map[string]string{"foo": "barbarbarbarbarbarbarbar"}))
+	if err != nil {
+		t.Fatalf("LayerFromOpener: %v", err)
+	}
+	compressed, err := l.Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	defer compressed.Close()
+	compressedBytes, err := io.ReadAll(compressed)
+	if err != nil {
+		t.Fatalf("reading compressed: %v", err)
+	}
+
+	uncompressed, err := l.Uncompressed()
+	if err != nil {
+		t.Fatalf("Uncompressed: %v", err)
+	}
+	defer uncompressed.Close()
+	uncompressedBytes, err := io.ReadAll(uncompressed)
+	if err != nil {
+		t.Fatalf("reading uncompressed: %v", err)
+	}
+
+	if bytes.Equal(compressedBytes, uncompressedBytes) {
+		t.Errorf("Compressed() returned the same bytes as Uncompressed(): default layer was never actually gzipped")
+	}
+}
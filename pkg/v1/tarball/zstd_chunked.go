@@ -0,0 +1,260 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ZstdChunkedMediaType is the OCI media type for a zstd-compressed tar
+// layer built by WithZstdChunked, with an embedded chunked TOC.
+const ZstdChunkedMediaType = types.MediaType("application/vnd.oci.image.layer.v1.tar+zstd")
+
+// defaultZstdChunkSize is the uncompressed size of each independently
+// compressed zstd frame in a zstd:chunked layer. This matches the chunk
+// size used elsewhere in the ecosystem for lazy-pull friendly layers.
+const defaultZstdChunkSize = 4 << 20 // 4 MiB
+
+// zstdChunkedFooterSize is the size, in bytes, of the fixed skippable
+// frame appended to the end of a zstd:chunked layer. Readers that want to
+// lazily fetch the TOC without downloading the whole blob can issue a
+// ranged read for exactly this many trailing bytes to learn where the TOC
+// frame starts.
+const zstdChunkedFooterSize = 4 + 4 + 8 + 8 // magic + skippable size + tocOffset + tocSize
+
+// zstdChunkedFooterMagic identifies the skippable frame written as the
+// zstd:chunked footer, per the zstd skippable frame format (magic number
+// 0x184D2A5? where ? is a nibble 0-15; we use 0).
+const zstdChunkedFooterMagic uint32 = 0x184D2A50
+
+// zstdChunkedTOCEntry records where a single tar entry's data landed in
+// the uncompressed tar stream that was split into chunks, so a puller
+// that already knows which files it needs can skip straight to the
+// chunk(s) containing them instead of decompressing the whole layer.
+type zstdChunkedTOCEntry struct {
+	Name               string `json:"name"`
+	Typeflag           byte   `json:"typeflag"`
+	Size               int64  `json:"size,omitempty"`
+	ManifestPosition   int    `json:"manifestPosition"`
+	UncompressedSize   int64  `json:"uncompressedSize"`
+	UncompressedOffset int64  `json:"uncompressedOffset"`
+}
+
+// zstdChunkedTOC is the JSON payload written as the last zstd frame of a
+// zstd:chunked layer, just before the footer.
+type zstdChunkedTOC struct {
+	Version   int                   `json:"version"`
+	ChunkSize int                   `json:"chunkSize"`
+	Entries   []zstdChunkedTOCEntry `json:"entries"`
+}
+
+// WithZstdChunked is a LayerOpt that, mirroring WithEstargz, builds the
+// layer as a zstd-compressed tar (application/vnd.oci.image.layer.v1.tar+zstd)
+// made up of independent, chunk-sized zstd frames plus a JSON TOC and
+// skippable-frame footer recording where each tar entry landed. This is a
+// go-containerregistry-specific layout, not the containers/storage
+// zstd:chunked manifest format: it is NOT readable by stargz-snapshotter,
+// containerd's remote-snapshotter, or other existing zstd:chunked pullers.
+// It exists so format-aware tooling within this module (see
+// LayerWithMissingPrioritizedFiles) can still honor PrioritizedFiles for a
+// zstd layer; anything else should use WithEstargz.
+func WithZstdChunked(o *layerOpts) error {
+	o.zstdChunked = true
+	return nil
+}
+
+// WithZstdChunkedChunkSize overrides the default 4 MiB chunk size used by
+// WithZstdChunked.
+func WithZstdChunkedChunkSize(size int) LayerOpt {
+	return func(o *layerOpts) error {
+		o.zstdChunkedChunkSize = size
+		return nil
+	}
+}
+
+// buildZstdChunked reads the uncompressed tar stream from r, reordering
+// entries named in prioritized to the front exactly like the eStargz
+// path, and writes a zstd:chunked layer to w. It returns the prioritized
+// files that were not found in the tar stream, matching the behavior of
+// estargz.WithAllowPrioritizeNotFound.
+func buildZstdChunked(w io.Writer, r io.Reader, chunkSize int, prioritized []string) ([]string, error) {
+	if chunkSize <= 0 {
+		chunkSize = defaultZstdChunkSize
+	}
+
+	entries, missing, err := reorderTarEntries(r, prioritized)
+	if err != nil {
+		return nil, fmt.Errorf("reordering tar entries: %w", err)
+	}
+
+	// Re-encode the (now reordered) entries into a plain uncompressed tar
+	// so we know each entry's exact byte offset before we start chunking.
+	var uncompressed bytes.Buffer
+	tw := tar.NewWriter(&uncompressed)
+	toc := zstdChunkedTOC{Version: 1, ChunkSize: chunkSize}
+	for i, e := range entries {
+		if err := tw.WriteHeader(e.header); err != nil {
+			return nil, fmt.Errorf("writing tar header for %q: %w", e.header.Name, err)
+		}
+		// tar.Writer writes the header blocks straight through, so this is
+		// where the entry's data begins.
+		offset := int64(uncompressed.Len())
+		if _, err := tw.Write(e.data); err != nil {
+			return nil, fmt.Errorf("writing tar data for %q: %w", e.header.Name, err)
+		}
+		toc.Entries = append(toc.Entries, zstdChunkedTOCEntry{
+			Name:               e.header.Name,
+			Typeflag:           e.header.Typeflag,
+			Size:               e.header.Size,
+			ManifestPosition:   i,
+			UncompressedSize:   e.header.Size,
+			UncompressedOffset: offset,
+		})
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("closing tar writer: %w", err)
+	}
+
+	tocOffset, err := writeZstdChunks(w, uncompressed.Bytes(), chunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("writing zstd chunks: %w", err)
+	}
+
+	tocBytes, err := json.Marshal(toc)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling TOC: %w", err)
+	}
+	tocFrameOffset := tocOffset
+	tocSize, err := writeZstdFrame(w, tocBytes)
+	if err != nil {
+		return nil, fmt.Errorf("writing TOC frame: %w", err)
+	}
+
+	if err := writeZstdChunkedFooter(w, tocFrameOffset, tocSize); err != nil {
+		return nil, fmt.Errorf("writing footer: %w", err)
+	}
+
+	return missing, nil
+}
+
+// writeZstdChunks splits data into chunkSize-sized pieces and writes each
+// as its own independent zstd frame, so a reader can decompress any single
+// chunk without needing the ones before it. It returns the offset, in w,
+// immediately following the last chunk frame, i.e. where the TOC frame
+// should begin.
+func writeZstdChunks(w io.Writer, data []byte, chunkSize int) (int64, error) {
+	var offset int64
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		written, err := writeZstdFrame(w, data[:n])
+		if err != nil {
+			return 0, err
+		}
+		offset += written
+		data = data[n:]
+	}
+	return offset, nil
+}
+
+// writeZstdFrame compresses buf as a single, independent zstd frame and
+// writes it to w, returning the number of compressed bytes written.
+func writeZstdFrame(w io.Writer, buf []byte) (int64, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer enc.Close()
+	compressed := enc.EncodeAll(buf, nil)
+	n, err := w.Write(compressed)
+	return int64(n), err
+}
+
+// writeZstdChunkedFooter appends a fixed-size zstd skippable frame
+// pointing at the TOC frame's offset and size, so readers can locate the
+// TOC with a single ranged read from the end of the blob.
+func writeZstdChunkedFooter(w io.Writer, tocOffset, tocSize int64) error {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, zstdChunkedFooterMagic)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(16)) // skippable frame content size
+	_ = binary.Write(&buf, binary.LittleEndian, tocOffset)
+	_ = binary.Write(&buf, binary.LittleEndian, tocSize)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// tarEntry is a fully buffered tar entry: its header plus its data. We
+// buffer entries in memory the same way estargz.Build does internally, so
+// that PrioritizedFiles can move matching entries to the front of the
+// stream before we start compressing.
+type tarEntry struct {
+	header *tar.Header
+	data   []byte
+}
+
+// reorderTarEntries reads every entry out of r, then returns them with
+// any entry whose name appears in prioritized moved to the front (in the
+// order prioritized lists them), exactly mirroring the reordering
+// estargz.Build performs for PrioritizedFiles. It also returns whichever
+// prioritized names were not found among the tar entries.
+func reorderTarEntries(r io.Reader, prioritized []string) ([]tarEntry, []string, error) {
+	tr := tar.NewReader(r)
+	byName := map[string]tarEntry{}
+	var order []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		byName[hdr.Name] = tarEntry{header: hdr, data: data}
+		order = append(order, hdr.Name)
+	}
+
+	seen := make(map[string]bool, len(prioritized))
+	entries := make([]tarEntry, 0, len(order))
+	var missing []string
+	for _, name := range prioritized {
+		if e, ok := byName[name]; ok {
+			entries = append(entries, e)
+			seen[name] = true
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	for _, name := range order {
+		if !seen[name] {
+			entries = append(entries, byName[name])
+		}
+	}
+	return entries, missing, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func tarOpener(files map[string]string) Opener {
+	return func() (io.ReadCloser, error) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, body := range files {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(body)), Mode: 0644}); err != nil {
+				return nil, err
+			}
+			if _, err := tw.Write([]byte(body)); err != nil {
+				return nil, err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+}
+
+func TestZstdChunkedDiffIDAndDigestDiffer(t *testing.T) {
+	l, err := LayerFromOpener(tarOpener(map[string]string{"foo": "bar"}), WithZstdChunked)
+	if err != nil {
+		t.Fatalf("LayerFromOpener: %v", err)
+	}
+
+	diffID, err := l.DiffID()
+	if err != nil {
+		t.Fatalf("DiffID: %v", err)
+	}
+	digest, err := l.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if diffID == digest {
+		t.Fatalf("DiffID and Digest must differ for a compressed layer, both got %s", diffID)
+	}
+
+	rc, err := l.Uncompressed()
+	if err != nil {
+		t.Fatalf("Uncompressed: %v", err)
+	}
+	defer rc.Close()
+	raw, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading uncompressed: %v", err)
+	}
+	wantDiffID, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("hashing uncompressed: %v", err)
+	}
+	if diffID != wantDiffID {
+		t.Errorf("DiffID = %s, want digest of uncompressed tar %s", diffID, wantDiffID)
+	}
+}
+
+func TestZstdChunkedHonorsPrioritizedFiles(t *testing.T) {
+	l, err := LayerFromOpener(
+		tarOpener(map[string]string{"foo": "bar"}),
+		WithZstdChunked,
+		WithEstargzOptions(estargz.WithPrioritizedFiles([]string{"foo", "does-not-exist"})),
+	)
+	if err != nil {
+		t.Fatalf("LayerFromOpener: %v", err)
+	}
+
+	lm, ok := l.(LayerWithMissingPrioritizedFiles)
+	if !ok {
+		t.Fatalf("layer does not implement LayerWithMissingPrioritizedFiles")
+	}
+	missing, err := lm.MissingPrioritizedFiles()
+	if err != nil {
+		t.Fatalf("MissingPrioritizedFiles: %v", err)
+	}
+	if len(missing) != 1 || missing[0] != "does-not-exist" {
+		t.Errorf("MissingPrioritizedFiles = %v, want [does-not-exist]", missing)
+	}
+}
+
+func TestZstdChunkedFooterHasMagic(t *testing.T) {
+	l, err := LayerFromOpener(tarOpener(map[string]string{"foo": "bar", "baz": "qux"}), WithZstdChunked)
+	if err != nil {
+		t.Fatalf("LayerFromOpener: %v", err)
+	}
+
+	rc, err := l.Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	defer rc.Close()
+	blob, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading compressed: %v", err)
+	}
+	if len(blob) < zstdChunkedFooterSize {
+		t.Fatalf("compressed layer shorter than the footer itself: %d bytes", len(blob))
+	}
+
+	footer := blob[len(blob)-zstdChunkedFooterSize:]
+	if got := leUint32(footer[0:4]); got != zstdChunkedFooterMagic {
+		t.Errorf("footer magic = %#x, want %#x", got, zstdChunkedFooterMagic)
+	}
+}
+
+func leUint32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}